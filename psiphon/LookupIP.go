@@ -1,5 +1,3 @@
-// +build android linux
-
 /*
  * Copyright (c) 2014, Psiphon Inc.
  * All rights reserved.
@@ -22,98 +20,95 @@
 package psiphon
 
 import (
-	"errors"
-	dns "github.com/Psiphon-Inc/dns"
+	"container/list"
+	"context"
 	"net"
-	"os"
-	"syscall"
-	"time"
+	"sync"
 )
 
-const DNS_PORT = 53
+// RESOLVER_CACHE_MAX_ENTRIES bounds the number of Resolvers held by
+// resolvers below. DialConfigs are often created per-dial rather than
+// held for a tunnel's lifetime, so without a bound this cache -- and the
+// DNS cache each Resolver carries -- would grow without limit.
+const RESOLVER_CACHE_MAX_ENTRIES = 100
 
-// LookupIP resolves a hostname. When BindToDevice is not required, it
-// simply uses net.LookupIP.
-// When BindToDevice is required, LookupIP explicitly creates a UDP
-// socket, binds it to the device, and makes an explicit DNS request
-// to the specified DNS resolver.
-func LookupIP(host string, config *DialConfig) (addrs []net.IP, err error) {
-	if config.BindToDeviceProvider != nil {
-		return bindLookupIP(host, config)
-	}
-	return net.LookupIP(host)
+// resolverCacheEntry pairs a DialConfig with the Resolver built for it.
+type resolverCacheEntry struct {
+	config   *DialConfig
+	resolver *Resolver
+	element  *list.Element
 }
 
-// bindLookupIP implements the BindToDevice LookupIP case.
-// To implement socket device binding, the lower-level syscall APIs are used.
-// The sequence of syscalls in this implementation are taken from:
-// https://code.google.com/p/go/issues/detail?id=6966
-func bindLookupIP(host string, config *DialConfig) (addrs []net.IP, err error) {
-
-	// When the input host is an IP address, echo it back
-	ipAddr := net.ParseIP(host)
-	if ipAddr != nil {
-		return []net.IP{ipAddr}, nil
-	}
-
-	socketFd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
-	if err != nil {
-		return nil, ContextError(err)
-	}
-	defer syscall.Close(socketFd)
+// resolverCache is a bounded, LRU cache of the Resolver built for each
+// DialConfig, so its DNS cache (see DialConfig's DnsCache* fields and
+// Resolver.cache) is shared across repeated lookups using the same
+// config, while evicting the least-recently-used Resolver once the
+// cache is full instead of growing forever.
+type resolverCache struct {
+	mutex   sync.Mutex
+	entries map[*DialConfig]*resolverCacheEntry
+	lru     *list.List
+}
 
-	// TODO: check BindToDevice result
-	config.BindToDeviceProvider.BindToDevice(socketFd)
+// resolvers caches the Resolver built for each DialConfig, so that its
+// DNS cache (see DialConfig's DnsCache* fields and Resolver.cache) is
+// actually shared across repeated lookups instead of being discarded
+// after a single call.
+var resolvers = &resolverCache{
+	entries: make(map[*DialConfig]*resolverCacheEntry),
+	lru:     list.New(),
+}
 
-	// config.BindToDeviceDnsServer must be an IP address
-	ipAddr = net.ParseIP(config.BindToDeviceDnsServer)
-	if ipAddr == nil {
-		return nil, ContextError(errors.New("invalid IP address"))
+// LookupIP resolves a hostname. When BindToDevice is not required, it
+// simply uses net.LookupIP. When BindToDevice is required, LookupIP uses
+// the Resolver cached for config -- which on Android/Linux dials DNS
+// servers through a device-bound socket, and on other platforms dials
+// with a plain net.Dialer -- building one on first use.
+//
+// When BindToDevice is required, ctx may be used to abort an in-flight
+// lookup, e.g., when the tunnel is being shut down. The net.LookupIP path
+// does not take ctx and is not aborted by it.
+func LookupIP(ctx context.Context, host string, config *DialConfig) (addrs []net.IP, err error) {
+	if config.BindToDeviceProvider == nil {
+		return net.LookupIP(host)
 	}
+	return resolverForConfig(config).LookupIP(ctx, host)
+}
 
-	// TODO: IPv6 support
-	var ip [4]byte
-	copy(ip[:], ipAddr.To4())
-	sockAddr := syscall.SockaddrInet4{Addr: ip, Port: DNS_PORT}
-	// Note: no timeout or interrupt for this connect, as it's a datagram socket
-	err = syscall.Connect(socketFd, &sockAddr)
-	if err != nil {
-		return nil, ContextError(err)
+// FlushDNSCache discards any lookups cached for config, e.g., in response
+// to a network change event. It's a no-op if LookupIP has not yet been
+// called with config.
+func FlushDNSCache(config *DialConfig) {
+	resolvers.mutex.Lock()
+	entry, ok := resolvers.entries[config]
+	resolvers.mutex.Unlock()
+	if ok {
+		entry.resolver.FlushCache()
 	}
+}
 
-	// Convert the syscall socket to a net.Conn, for use in the dns package
-	file := os.NewFile(uintptr(socketFd), "")
-	defer file.Close()
-	conn, err := net.FileConn(file)
-	if err != nil {
-		return nil, ContextError(err)
-	}
+func resolverForConfig(config *DialConfig) *Resolver {
+	resolvers.mutex.Lock()
+	defer resolvers.mutex.Unlock()
 
-	// Set DNS query timeouts, using the ConnectTimeout from the overall Dial
-	if config.ConnectTimeout != 0 {
-		conn.SetReadDeadline(time.Now().Add(config.ConnectTimeout))
-		conn.SetWriteDeadline(time.Now().Add(config.ConnectTimeout))
+	if entry, ok := resolvers.entries[config]; ok {
+		resolvers.lru.MoveToFront(entry.element)
+		return entry.resolver
 	}
 
-	// Make the DNS query
-	// TODO: make interruptible?
-	dnsConn := &dns.Conn{Conn: conn}
-	defer dnsConn.Close()
-	query := new(dns.Msg)
-	query.SetQuestion(dns.Fqdn(host), dns.TypeA)
-	query.RecursionDesired = true
-	dnsConn.WriteMsg(query)
+	entry := &resolverCacheEntry{config: config, resolver: NewResolver(config)}
+	entry.element = resolvers.lru.PushFront(entry)
+	resolvers.entries[config] = entry
 
-	// Process the response
-	response, err := dnsConn.ReadMsg()
-	if err != nil {
-		return nil, ContextError(err)
-	}
-	addrs = make([]net.IP, 0)
-	for _, answer := range response.Answer {
-		if a, ok := answer.(*dns.A); ok {
-			addrs = append(addrs, a.A)
+	for len(resolvers.entries) > RESOLVER_CACHE_MAX_ENTRIES {
+		oldest := resolvers.lru.Back()
+		if oldest == nil {
+			break
 		}
+		oldestEntry := oldest.Value.(*resolverCacheEntry)
+		resolvers.lru.Remove(oldest)
+		delete(resolvers.entries, oldestEntry.config)
 	}
-	return addrs, nil
+
+	return entry.resolver
 }
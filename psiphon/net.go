@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// BindToDeviceProvider binds a raw socket, by file descriptor, to a
+// particular network device. It's implemented by the host application on
+// platforms (Android, Linux) where tunnel traffic -- and, via
+// DialConfig's BindToDeviceProvider field, DNS traffic -- must be routed
+// through a specific device rather than the system default route.
+type BindToDeviceProvider interface {
+	BindToDevice(fileDescriptor int) error
+}
+
+// PendingConns tracks net.Conns that are in the process of being
+// established, so they can all be aborted at once on an interrupt, e.g.,
+// when a tunnel is being shut down while a dial is still in progress.
+type PendingConns struct {
+	mutex  sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+// NewPendingConns creates a PendingConns.
+func NewPendingConns() *PendingConns {
+	return &PendingConns{conns: make(map[net.Conn]bool)}
+}
+
+// Add registers conn, so a subsequent CloseAll will abort it. It returns
+// false, without registering conn, once CloseAll has been called.
+func (p *PendingConns) Add(conn net.Conn) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = true
+	return true
+}
+
+// Remove deregisters conn, e.g., once it's no longer pending and is
+// either established or has failed.
+func (p *PendingConns) Remove(conn net.Conn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.conns, conn)
+}
+
+// CloseAll closes every currently registered conn and marks PendingConns
+// closed, so that subsequent Add calls fail and future dials can detect
+// the interrupt immediately instead of registering.
+func (p *PendingConns) CloseAll() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = make(map[net.Conn]bool)
+}
+
+// DialConfig specifies the parameters for a dial, including the DNS
+// resolution (see Resolver and LookupIP) performed as part of
+// establishing it.
+type DialConfig struct {
+
+	// ConnectTimeout, when not zero, bounds the time allowed to
+	// establish a connection, including any DNS resolution performed
+	// first.
+	ConnectTimeout time.Duration
+
+	// BindToDeviceProvider, when not nil, is used to bind dialed
+	// sockets -- including the Resolver's DNS sockets -- to a
+	// particular network device.
+	BindToDeviceProvider BindToDeviceProvider
+
+	// BindToDeviceDnsServer is the DNS server IP address used when
+	// BindToDeviceProvider is set and BindToDeviceDnsServers is empty.
+	BindToDeviceDnsServer string
+
+	// BindToDeviceDnsServers, when not empty, lists the DNS server IP
+	// addresses Resolver races queries across; BindToDeviceDnsServer is
+	// used as a single-server fallback when this is empty.
+	BindToDeviceDnsServers []string
+
+	// PendingConns, when set, registers connections dialed for this
+	// config -- including UDP, TCP, and DoT DNS connections, but not
+	// pooled DoH connections -- so an interrupt can abort them all at
+	// once.
+	PendingConns *PendingConns
+
+	// DnsPreferIPv4 and DnsPreferIPv6 restrict DNS resolution to a
+	// single record type; when both are false, both A and AAAA are
+	// queried. See Resolver.PreferIPv4/PreferIPv6.
+	DnsPreferIPv4 bool
+	DnsPreferIPv6 bool
+
+	// DnsTransport selects the DNS transport used by Resolver: one of
+	// DNS_TRANSPORT_UDP (the default), DNS_TRANSPORT_TCP,
+	// DNS_TRANSPORT_DOT, or DNS_TRANSPORT_DOH.
+	DnsTransport string
+
+	// DnsServerURL is the DoH endpoint used when DnsTransport is
+	// DNS_TRANSPORT_DOH.
+	DnsServerURL string
+
+	// DnsServerCertificateSPKIHashes, when not empty, pins the DoT/DoH
+	// server's certificate. See Resolver.ServerCertificateSPKIHashes.
+	DnsServerCertificateSPKIHashes []string
+
+	// DnsCacheMaxEntries, DnsCacheMinTTL, and DnsCacheMaxTTL configure
+	// Resolver's DNS cache; see NewResolver. All three are zero by
+	// default, which leaves the cache disabled.
+	DnsCacheMaxEntries int
+	DnsCacheMinTTL     time.Duration
+	DnsCacheMaxTTL     time.Duration
+}
@@ -0,0 +1,451 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	dns "github.com/Psiphon-Inc/dns"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DNS_PORT                      = 53
+	DNS_OVER_TLS_PORT             = 853
+	DNS_RESOLVER_STAGGER_DELAY    = 300 * time.Millisecond
+	DNS_RESOLVER_MAX_ATTEMPTS     = 3
+	DNS_RESOLVER_RETRY_BASE_DELAY = 100 * time.Millisecond
+
+	// DNS_TRANSPORT_UDP and DNS_TRANSPORT_TCP are plain, unencrypted DNS,
+	// dialed via Resolver.Dial. DNS_TRANSPORT_DOT and DNS_TRANSPORT_DOH
+	// are encrypted transports, RFC 7858 DNS-over-TLS and RFC 8484
+	// DNS-over-HTTPS, respectively; both still dial their underlying
+	// connection via Resolver.Dial, so BindToDeviceProvider is honored.
+	DNS_TRANSPORT_UDP = "udp"
+	DNS_TRANSPORT_TCP = "tcp"
+	DNS_TRANSPORT_DOT = "dot"
+	DNS_TRANSPORT_DOH = "doh"
+)
+
+// Resolver performs DNS resolution using a caller-supplied Dial function
+// for all DNS transport, analogous to net.Resolver.Dial. This allows DNS
+// queries to be routed through arbitrary transports -- a device-bound
+// socket, a Psiphon tunnel, a SOCKS proxy, or an in-process fake for
+// tests -- instead of being tied to one dialing strategy.
+type Resolver struct {
+	// Dial is used to establish the connection for each DNS query.
+	// network is "udp" or "tcp"; address is "host:port". NewResolver
+	// sets Dial to the platform default, defaultDial; a Resolver built
+	// without NewResolver must set Dial, as there is no fallback when it
+	// is nil.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Servers is the list of DNS server IP addresses to query.
+	Servers []string
+
+	// PreferIPv4 and PreferIPv6 restrict LookupIP to a single record
+	// type; when both are false, both A and AAAA are queried.
+	PreferIPv4 bool
+	PreferIPv6 bool
+
+	// QueryTimeout bounds each individual query attempt.
+	QueryTimeout time.Duration
+
+	// PendingConns, when set, registers UDP, TCP, and DoT DNS connections
+	// so an interrupt (e.g., tunnel shutdown) aborts in-flight queries.
+	// DoH connections are pooled by the DoH http.Transport and are not
+	// registered; DoH queries are aborted only via ctx.
+	PendingConns *PendingConns
+
+	// Transport selects the DNS transport: one of DNS_TRANSPORT_UDP
+	// (the default), DNS_TRANSPORT_TCP, DNS_TRANSPORT_DOT, or
+	// DNS_TRANSPORT_DOH.
+	Transport string
+
+	// ServerURL is the "https://host/path" endpoint used when Transport
+	// is DNS_TRANSPORT_DOH.
+	ServerURL string
+
+	// ServerCertificateSPKIHashes, when not empty, pins the DoT/DoH
+	// server's certificate: at least one certificate in the presented
+	// chain must have a SubjectPublicKeyInfo hash in this list.
+	ServerCertificateSPKIHashes []string
+
+	// cache, when not nil, fronts LookupIP with a concurrent,
+	// single-flight, TTL-aware cache. See newDNSCache.
+	cache *dnsCache
+
+	// dohTransportOnce and dohRoundTripper cache the http.RoundTripper
+	// built for DNS_TRANSPORT_DOH, so it's built once per Resolver and
+	// reused -- connections and all -- across queryDoH calls. See
+	// dohTransport.
+	dohTransportOnce sync.Once
+	dohRoundTripper  http.RoundTripper
+}
+
+// NewResolver creates a Resolver configured from a DialConfig. Its Dial
+// function defaults to the platform-appropriate implementation of
+// defaultDial: on Android/Linux, queries are dialed through a
+// device-bound socket via config.BindToDeviceProvider; on other
+// platforms, a net.Dialer is used. This Dial function underlies every
+// transport, including DNS_TRANSPORT_DOT and DNS_TRANSPORT_DOH, so
+// BindToDeviceProvider is honored regardless of transport.
+func NewResolver(config *DialConfig) *Resolver {
+	resolver := &Resolver{
+		Dial:                        defaultDial(config),
+		Servers:                     config.BindToDeviceDnsServers,
+		PreferIPv4:                  config.DnsPreferIPv4,
+		PreferIPv6:                  config.DnsPreferIPv6,
+		QueryTimeout:                config.ConnectTimeout,
+		PendingConns:                config.PendingConns,
+		Transport:                   config.DnsTransport,
+		ServerURL:                   config.DnsServerURL,
+		ServerCertificateSPKIHashes: config.DnsServerCertificateSPKIHashes,
+	}
+	if resolver.Transport == "" {
+		resolver.Transport = DNS_TRANSPORT_UDP
+	}
+	if len(resolver.Servers) == 0 && config.BindToDeviceDnsServer != "" {
+		resolver.Servers = []string{config.BindToDeviceDnsServer}
+	}
+	if resolver.Transport == DNS_TRANSPORT_DOH && len(resolver.Servers) == 0 {
+		// DoH has no per-query server IP; ServerURL is the only
+		// endpoint, but raceServers still needs one entry to drive a
+		// single query attempt (and retries).
+		resolver.Servers = []string{resolver.ServerURL}
+	}
+	if config.DnsCacheMaxEntries != 0 || config.DnsCacheMinTTL != 0 || config.DnsCacheMaxTTL != 0 {
+		resolver.cache = newDNSCache(
+			config.DnsCacheMaxEntries, config.DnsCacheMinTTL, config.DnsCacheMaxTTL)
+	}
+	return resolver
+}
+
+// FlushCache discards all cached lookups, e.g., in response to a network
+// change event. It's a no-op when no cache is configured.
+func (r *Resolver) FlushCache() {
+	if r.cache != nil {
+		r.cache.flush()
+	}
+}
+
+// LookupIP resolves host using r's configured servers and Dial function.
+// When host is an IP address literal, it's echoed back without a query.
+// When r.cache is configured (see NewResolver and DialConfig's DnsCache*
+// fields), concurrent lookups for the same host coalesce into one
+// on-wire resolution, and the result is cached for the resolved TTL
+// (successes) or a bounded negative TTL (failures).
+//
+// Both A and AAAA records are queried in parallel, unless r.PreferIPv4 or
+// r.PreferIPv6 restricts the lookup to a single record type. When r.Servers
+// lists more than one resolver, each query races across them
+// Happy-Eyeballs-style, retrying with exponential backoff on timeout or
+// SERVFAIL, and falling back to TCP when the UDP response is truncated.
+func (r *Resolver) LookupIP(ctx context.Context, host string) (addrs []net.IP, err error) {
+
+	ipAddr := net.ParseIP(host)
+	if ipAddr != nil {
+		return []net.IP{ipAddr}, nil
+	}
+
+	if r.cache == nil {
+		addrs, _, err := r.lookupIP(ctx, host)
+		return addrs, err
+	}
+	return r.cache.lookup(host, func() ([]net.IP, time.Duration, error) {
+		return r.lookupIP(ctx, host)
+	})
+}
+
+// lookupIP is the uncached implementation of LookupIP. It additionally
+// returns the minimum TTL among the returned records, as a
+// time.Duration, for use by the caching layer.
+func (r *Resolver) lookupIP(ctx context.Context, host string) (addrs []net.IP, ttl time.Duration, err error) {
+
+	if len(r.Servers) == 0 {
+		return nil, 0, ContextError(errors.New("no DNS servers configured"))
+	}
+	// DoH queries r.ServerURL and ignores the server value, which may
+	// itself be ServerURL (see NewResolver), so only the other
+	// transports require IP addresses.
+	if r.Transport != DNS_TRANSPORT_DOH {
+		for _, server := range r.Servers {
+			if net.ParseIP(server) == nil {
+				return nil, 0, ContextError(errors.New("invalid IP address"))
+			}
+		}
+	}
+
+	var queryTypes []uint16
+	switch {
+	case r.PreferIPv4:
+		queryTypes = []uint16{dns.TypeA}
+	case r.PreferIPv6:
+		queryTypes = []uint16{dns.TypeAAAA}
+	default:
+		queryTypes = []uint16{dns.TypeA, dns.TypeAAAA}
+	}
+
+	type queryResult struct {
+		addrs []net.IP
+		ttl   time.Duration
+		err   error
+	}
+
+	results := make(chan queryResult, len(queryTypes))
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(len(queryTypes))
+	for _, queryType := range queryTypes {
+		go func(queryType uint16) {
+			defer waitGroup.Done()
+			queryAddrs, queryTTL, queryErr := r.raceServers(ctx, host, queryType)
+			results <- queryResult{addrs: queryAddrs, ttl: queryTTL, err: queryErr}
+		}(queryType)
+	}
+	waitGroup.Wait()
+	close(results)
+
+	addrs = make([]net.IP, 0)
+	ttl = 0
+	haveTTL := false
+	var lastErr error
+	for result := range results {
+		if result.err != nil {
+			lastErr = result.err
+			continue
+		}
+		addrs = append(addrs, result.addrs...)
+		// A query type with no records (e.g., no AAAA for an IPv4-only
+		// host) returns ttl 0 with no error; that's not a TTL
+		// observation, so it must not collide with and collapse the
+		// TTL of a query type that did return records.
+		if len(result.addrs) == 0 {
+			continue
+		}
+		if !haveTTL || result.ttl < ttl {
+			ttl = result.ttl
+			haveTTL = true
+		}
+	}
+	if len(addrs) == 0 && lastErr != nil {
+		return nil, 0, lastErr
+	}
+	return addrs, ttl, nil
+}
+
+// raceServers queries each of r.Servers, staggered Happy-Eyeballs-style,
+// and returns the first successful result. If ctx is done or every
+// server fails, the last error encountered is returned.
+func (r *Resolver) raceServers(ctx context.Context, host string, queryType uint16) (addrs []net.IP, ttl time.Duration, err error) {
+
+	type queryResult struct {
+		addrs []net.IP
+		ttl   time.Duration
+		err   error
+	}
+
+	resultChan := make(chan queryResult, len(r.Servers))
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for i, server := range r.Servers {
+		delay := time.Duration(i) * DNS_RESOLVER_STAGGER_DELAY
+		go func(server string, delay time.Duration) {
+			select {
+			case <-time.After(delay):
+			case <-raceCtx.Done():
+				resultChan <- queryResult{err: raceCtx.Err()}
+				return
+			}
+			queryAddrs, queryTTL, queryErr := r.queryWithRetry(raceCtx, host, queryType, server)
+			resultChan <- queryResult{addrs: queryAddrs, ttl: queryTTL, err: queryErr}
+		}(server, delay)
+	}
+
+	var lastErr error
+	for i := 0; i < len(r.Servers); i++ {
+		result := <-resultChan
+		if result.err == nil {
+			return result.addrs, result.ttl, nil
+		}
+		lastErr = result.err
+	}
+	return nil, 0, lastErr
+}
+
+// queryWithRetry issues a DNS query against server, retrying with
+// exponential backoff on timeout or SERVFAIL, up to
+// DNS_RESOLVER_MAX_ATTEMPTS times, and falling back to TCP when the UDP
+// response is truncated.
+func (r *Resolver) queryWithRetry(ctx context.Context, host string, queryType uint16, server string) (addrs []net.IP, ttl time.Duration, err error) {
+
+	retryDelay := DNS_RESOLVER_RETRY_BASE_DELAY
+	for attempt := 0; attempt < DNS_RESOLVER_MAX_ATTEMPTS; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+				return nil, 0, ContextError(ctx.Err())
+			}
+			retryDelay *= 2
+		}
+
+		response, queryErr := r.query(ctx, host, queryType, server, false)
+		if queryErr != nil {
+			err = queryErr
+			continue
+		}
+
+		if response.Truncated {
+			response, queryErr = r.query(ctx, host, queryType, server, true)
+			if queryErr != nil {
+				err = queryErr
+				continue
+			}
+		}
+
+		if response.Rcode == dns.RcodeServerFailure {
+			err = ContextError(errors.New("DNS server failure"))
+			continue
+		}
+
+		if response.Rcode == dns.RcodeNameError {
+			// NXDOMAIN is an authoritative negative answer, not a
+			// transient failure: don't retry, and surface it as an
+			// error so dnsCache.lookup takes the negative-TTL path
+			// instead of caching an empty result as a success.
+			return nil, 0, ContextError(errors.New("DNS name error"))
+		}
+
+		resultAddrs, resultTTL := answersForName(response.Answer, dns.Fqdn(host))
+		return resultAddrs, resultTTL, nil
+	}
+	return nil, 0, err
+}
+
+// query issues a single DNS query of the given record type against
+// server, using r.Transport, and returns the response message. useTCP
+// forces TCP for the UDP/TCP transports (required when retrying a
+// truncated UDP response); DOT and DOH are always stream-based and
+// ignore useTCP.
+func (r *Resolver) query(ctx context.Context, host string, queryType uint16, server string, useTCP bool) (response *dns.Msg, err error) {
+
+	switch r.Transport {
+	case DNS_TRANSPORT_DOT:
+		return r.queryDoT(ctx, host, queryType, server)
+	case DNS_TRANSPORT_DOH:
+		return r.queryDoH(ctx, host, queryType)
+	}
+
+	network := "udp"
+	if useTCP || r.Transport == DNS_TRANSPORT_TCP {
+		network = "tcp"
+	}
+	address := net.JoinHostPort(server, strconv.Itoa(DNS_PORT))
+
+	queryCtx := ctx
+	if r.QueryTimeout != 0 {
+		var cancel context.CancelFunc
+		queryCtx, cancel = context.WithTimeout(ctx, r.QueryTimeout)
+		defer cancel()
+	}
+
+	conn, err := r.Dial(queryCtx, network, address)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer conn.Close()
+
+	// Register with the pending conns tracker used elsewhere in psiphon
+	// so that an interrupt (e.g., tunnel shutdown) aborts this query
+	// promptly, in addition to the deadline set below.
+	if r.PendingConns != nil {
+		if !r.PendingConns.Add(conn) {
+			return nil, ContextError(errors.New("pending conns is closed"))
+		}
+		defer r.PendingConns.Remove(conn)
+	}
+
+	if deadline, ok := queryCtx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	dnsConn := &dns.Conn{Conn: conn}
+	defer dnsConn.Close()
+	err = dnsConn.WriteMsg(newQueryMsg(host, queryType))
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	response, err = dnsConn.ReadMsg()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return response, nil
+}
+
+// newQueryMsg builds a recursive DNS query message for host and
+// queryType, shared by every transport.
+func newQueryMsg(host string, queryType uint16) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(host), queryType)
+	query.RecursionDesired = true
+	return query
+}
+
+// answersForName follows any CNAME chain rooted at queryName and returns
+// the A/AAAA addresses from the answer records for the final name, along
+// with the minimum TTL among those records (0 if there are none).
+func answersForName(answers []dns.RR, queryName string) (addrs []net.IP, ttl time.Duration) {
+	targetName := queryName
+	for _, answer := range answers {
+		if cname, ok := answer.(*dns.CNAME); ok && cname.Hdr.Name == targetName {
+			targetName = cname.Target
+		}
+	}
+	addrs = make([]net.IP, 0)
+	var minTTLSeconds uint32
+	haveTTL := false
+	for _, answer := range answers {
+		switch record := answer.(type) {
+		case *dns.A:
+			if record.Hdr.Name == targetName {
+				addrs = append(addrs, record.A)
+				if !haveTTL || record.Hdr.Ttl < minTTLSeconds {
+					minTTLSeconds = record.Hdr.Ttl
+					haveTTL = true
+				}
+			}
+		case *dns.AAAA:
+			if record.Hdr.Name == targetName {
+				addrs = append(addrs, record.AAAA)
+				if !haveTTL || record.Hdr.Ttl < minTTLSeconds {
+					minTTLSeconds = record.Hdr.Ttl
+					haveTTL = true
+				}
+			}
+		}
+	}
+	return addrs, time.Duration(minTTLSeconds) * time.Second
+}
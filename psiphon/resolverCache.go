@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DNS_CACHE_DEFAULT_MAX_ENTRIES = 1000
+	DNS_CACHE_DEFAULT_MIN_TTL     = 10 * time.Second
+	DNS_CACHE_DEFAULT_MAX_TTL     = 24 * time.Hour
+	DNS_CACHE_NEGATIVE_TTL        = 30 * time.Second
+)
+
+// dnsCacheEntry is one cached lookup result, either a success (addrs set,
+// err nil) or a failure (err set), and its expiry.
+type dnsCacheEntry struct {
+	host      string
+	addrs     []net.IP
+	err       error
+	expiresAt time.Time
+	element   *list.Element
+}
+
+// dnsCacheCall tracks a single-flight lookup in progress, shared by every
+// caller that requests the same host while it's outstanding.
+type dnsCacheCall struct {
+	done  chan struct{}
+	addrs []net.IP
+	err   error
+}
+
+// dnsCache is a concurrent, single-flight, TTL-aware cache fronting
+// Resolver.lookupIP: concurrent lookups for the same host coalesce into a
+// single on-wire resolution, successful results are cached for their
+// record TTL (clamped to [minTTL, maxTTL]), and failures are cached for a
+// bounded negative TTL to avoid amplifying failures during outages.
+type dnsCache struct {
+	mutex      sync.Mutex
+	entries    map[string]*dnsCacheEntry
+	lru        *list.List
+	inFlight   map[string]*dnsCacheCall
+	maxEntries int
+	minTTL     time.Duration
+	maxTTL     time.Duration
+}
+
+// newDNSCache creates a dnsCache. A zero maxEntries, minTTL, or maxTTL is
+// replaced with its DNS_CACHE_DEFAULT_* value.
+func newDNSCache(maxEntries int, minTTL, maxTTL time.Duration) *dnsCache {
+	if maxEntries <= 0 {
+		maxEntries = DNS_CACHE_DEFAULT_MAX_ENTRIES
+	}
+	if minTTL <= 0 {
+		minTTL = DNS_CACHE_DEFAULT_MIN_TTL
+	}
+	if maxTTL <= 0 {
+		maxTTL = DNS_CACHE_DEFAULT_MAX_TTL
+	}
+	return &dnsCache{
+		entries:    make(map[string]*dnsCacheEntry),
+		lru:        list.New(),
+		inFlight:   make(map[string]*dnsCacheCall),
+		maxEntries: maxEntries,
+		minTTL:     minTTL,
+		maxTTL:     maxTTL,
+	}
+}
+
+// flush discards all cached entries, e.g., on a network change event.
+// In-flight single-flight calls are left to complete and populate the
+// cache as usual.
+func (c *dnsCache) flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[string]*dnsCacheEntry)
+	c.lru.Init()
+}
+
+// lookup returns the cached result for host, if any and unexpired;
+// otherwise it calls fetch to resolve host -- coalescing concurrent
+// callers for the same host into a single call -- caches the outcome,
+// and returns it.
+func (c *dnsCache) lookup(host string, fetch func() ([]net.IP, time.Duration, error)) (addrs []net.IP, err error) {
+
+	if addrs, err, ok := c.get(host); ok {
+		return addrs, err
+	}
+
+	c.mutex.Lock()
+	if call, ok := c.inFlight[host]; ok {
+		c.mutex.Unlock()
+		<-call.done
+		return call.addrs, call.err
+	}
+	call := &dnsCacheCall{done: make(chan struct{})}
+	c.inFlight[host] = call
+	c.mutex.Unlock()
+
+	addrs, ttl, err := fetch()
+
+	if err != nil {
+		ttl = DNS_CACHE_NEGATIVE_TTL
+	} else if ttl < c.minTTL {
+		ttl = c.minTTL
+	} else if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	c.put(host, addrs, err, ttl)
+
+	call.addrs, call.err = addrs, err
+	close(call.done)
+
+	c.mutex.Lock()
+	delete(c.inFlight, host)
+	c.mutex.Unlock()
+
+	return addrs, err
+}
+
+func (c *dnsCache) get(host string) (addrs []net.IP, err error, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[host]
+	if !ok {
+		return nil, nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		c.lru.Remove(entry.element)
+		delete(c.entries, host)
+		return nil, nil, false
+	}
+	c.lru.MoveToFront(entry.element)
+	return entry.addrs, entry.err, true
+}
+
+func (c *dnsCache) put(host string, addrs []net.IP, err error, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if existing, ok := c.entries[host]; ok {
+		c.lru.Remove(existing.element)
+		delete(c.entries, host)
+	}
+
+	entry := &dnsCacheEntry{host: host, addrs: addrs, err: err, expiresAt: time.Now().Add(ttl)}
+	entry.element = c.lru.PushFront(entry)
+	c.entries[host] = entry
+
+	for len(c.entries) > c.maxEntries {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		oldestEntry := oldest.Value.(*dnsCacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, oldestEntry.host)
+	}
+}
@@ -0,0 +1,105 @@
+// +build android linux
+
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// defaultDial returns the Android/Linux default Resolver.Dial: a
+// device-bound socket connected directly to the DNS server, using the
+// lower-level syscall APIs required to bind the socket to the tunneled
+// device. The sequence of syscalls is taken from:
+// https://code.google.com/p/go/issues/detail?id=6966
+func defaultDial(config *DialConfig) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+
+		if config.BindToDeviceProvider == nil {
+			dialer := &net.Dialer{}
+			return dialer.DialContext(ctx, network, address)
+		}
+
+		host, portStr, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		resolverIP := net.ParseIP(host)
+		if resolverIP == nil {
+			return nil, ContextError(errors.New("invalid IP address"))
+		}
+		resolverIsIPv4 := resolverIP.To4() != nil
+
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+
+		socketFamily := syscall.AF_INET
+		if !resolverIsIPv4 {
+			socketFamily = syscall.AF_INET6
+		}
+		socketType := syscall.SOCK_DGRAM
+		if network == "tcp" {
+			socketType = syscall.SOCK_STREAM
+		}
+
+		socketFd, err := syscall.Socket(socketFamily, socketType, 0)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+
+		// TODO: check BindToDevice result
+		config.BindToDeviceProvider.BindToDevice(socketFd)
+
+		// Note: syscall.Connect blocks and does not observe ctx. For a
+		// UDP socket it completes without network I/O; for a TCP socket
+		// it waits for the handshake, and neither ctx nor any deadline
+		// later set on the returned net.Conn bounds that wait.
+		if resolverIsIPv4 {
+			var ip [4]byte
+			copy(ip[:], resolverIP.To4())
+			err = syscall.Connect(socketFd, &syscall.SockaddrInet4{Addr: ip, Port: port})
+		} else {
+			var ip [16]byte
+			copy(ip[:], resolverIP.To16())
+			err = syscall.Connect(socketFd, &syscall.SockaddrInet6{Addr: ip, Port: port})
+		}
+		if err != nil {
+			syscall.Close(socketFd)
+			return nil, ContextError(err)
+		}
+
+		// Convert the syscall socket to a net.Conn
+		file := os.NewFile(uintptr(socketFd), "")
+		defer file.Close()
+		conn, err := net.FileConn(file)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		return conn, nil
+	}
+}
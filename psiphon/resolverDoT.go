@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	dns "github.com/Psiphon-Inc/dns"
+	"net"
+	"strconv"
+)
+
+// queryDoT issues a DNS-over-TLS (RFC 7858) query against server, on the
+// standard port 853. The underlying TCP connection is dialed via r.Dial,
+// so BindToDeviceProvider is honored just as with plain UDP/TCP, and the
+// query is then exchanged as a standard length-prefixed DNS message over
+// the TLS session.
+func (r *Resolver) queryDoT(ctx context.Context, host string, queryType uint16, server string) (response *dns.Msg, err error) {
+
+	address := net.JoinHostPort(server, strconv.Itoa(DNS_OVER_TLS_PORT))
+
+	queryCtx := ctx
+	if r.QueryTimeout != 0 {
+		var cancel context.CancelFunc
+		queryCtx, cancel = context.WithTimeout(ctx, r.QueryTimeout)
+		defer cancel()
+	}
+
+	conn, err := r.Dial(queryCtx, "tcp", address)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer conn.Close()
+
+	if r.PendingConns != nil {
+		if !r.PendingConns.Add(conn) {
+			return nil, ContextError(errors.New("pending conns is closed"))
+		}
+		defer r.PendingConns.Remove(conn)
+	}
+
+	if deadline, ok := queryCtx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// ServerName is the resolver's IP address, since r.Servers are IP
+	// addresses (see lookupIP); without ServerCertificateSPKIHashes
+	// pinning, this only verifies against a certificate that carries
+	// that IP as a SAN, which most hostname-issued certificates don't.
+	// Operators pointing DoT at a server without such a certificate
+	// must supply ServerCertificateSPKIHashes.
+	tlsConn := tls.Client(
+		conn,
+		&tls.Config{
+			ServerName:            server,
+			InsecureSkipVerify:    len(r.ServerCertificateSPKIHashes) > 0,
+			VerifyPeerCertificate: verifyPinnedCertificate(r.ServerCertificateSPKIHashes),
+		})
+	err = tlsConn.Handshake()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	dnsConn := &dns.Conn{Conn: tlsConn}
+	defer dnsConn.Close()
+	err = dnsConn.WriteMsg(newQueryMsg(host, queryType))
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	response, err = dnsConn.ReadMsg()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return response, nil
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	dns "github.com/Psiphon-Inc/dns"
+)
+
+// capturingDial returns a Resolver.Dial that records the address it was
+// asked to dial and then fails, so callers that only need to inspect the
+// dial target don't have to stand up a real DNS/TLS server.
+func capturingDial(capturedAddress *string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		*capturedAddress = address
+		return nil, errors.New("test: refusing to dial")
+	}
+}
+
+func TestQueryDoTDialsOnDNSOverTLSPort(t *testing.T) {
+
+	var dialedAddress string
+	resolver := &Resolver{Dial: capturingDial(&dialedAddress)}
+
+	_, _ = resolver.queryDoT(context.Background(), "example.com", dns.TypeA, "127.0.0.1")
+
+	_, port, err := net.SplitHostPort(dialedAddress)
+	if err != nil {
+		t.Fatalf("SplitHostPort failed for %q: %s", dialedAddress, err)
+	}
+	if port != "853" {
+		t.Fatalf("expected DoT to dial port 853, got %q (address %q)", port, dialedAddress)
+	}
+}
+
+func TestQueryDoHDialsOnHTTPSPort(t *testing.T) {
+
+	var dialedAddress string
+	resolver := &Resolver{
+		Dial:      capturingDial(&dialedAddress),
+		ServerURL: "https://doh.example.com/dns-query",
+	}
+
+	_, _ = resolver.queryDoH(context.Background(), "example.com", dns.TypeA)
+
+	_, port, err := net.SplitHostPort(dialedAddress)
+	if err != nil {
+		t.Fatalf("SplitHostPort failed for %q: %s", dialedAddress, err)
+	}
+	if port != "443" {
+		t.Fatalf("expected DoH to dial port 443, got %q (address %q)", port, dialedAddress)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+)
+
+// verifyPinnedCertificate returns a tls.Config.VerifyPeerCertificate
+// callback that accepts the presented chain if and only if at least one
+// certificate in it has a SubjectPublicKeyInfo hash in pinnedSPKIHashes
+// (base64-encoded SHA-256). When pinnedSPKIHashes is empty, the callback
+// accepts any chain, deferring to the usual CA-based verification.
+func verifyPinnedCertificate(pinnedSPKIHashes []string) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(pinnedSPKIHashes) == 0 {
+			return nil
+		}
+		for _, rawCert := range rawCerts {
+			cert, err := x509.ParseCertificate(rawCert)
+			if err != nil {
+				continue
+			}
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			hash := base64.StdEncoding.EncodeToString(sum[:])
+			for _, pinnedHash := range pinnedSPKIHashes {
+				if hash == pinnedHash {
+					return nil
+				}
+			}
+		}
+		return ContextError(errors.New("no certificate matched a pinned SPKI hash"))
+	}
+}
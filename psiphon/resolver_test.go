@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	dns "github.com/Psiphon-Inc/dns"
+)
+
+// fakeDNSDial returns a Resolver.Dial that serves queries over an
+// in-memory net.Pipe, using answer to build the response for each query
+// it receives. This is the "fake resolver connection ... canned dns.Msg
+// responses" injection point the Dial hook exists to enable.
+func fakeDNSDial(answer func(query *dns.Msg) *dns.Msg) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			serverDNSConn := &dns.Conn{Conn: serverConn}
+			query, err := serverDNSConn.ReadMsg()
+			if err != nil {
+				serverConn.Close()
+				return
+			}
+			serverDNSConn.WriteMsg(answer(query))
+			serverConn.Close()
+		}()
+		return clientConn, nil
+	}
+}
+
+func TestResolverLookupIPReturnsAddresses(t *testing.T) {
+
+	answer := func(query *dns.Msg) *dns.Msg {
+		response := new(dns.Msg)
+		response.SetReply(query)
+		if query.Question[0].Qtype == dns.TypeA {
+			rr, err := dns.NewRR(query.Question[0].Name + " 300 IN A 127.0.0.1")
+			if err != nil {
+				t.Fatalf("NewRR failed: %s", err)
+			}
+			response.Answer = append(response.Answer, rr)
+		}
+		return response
+	}
+
+	resolver := &Resolver{
+		Dial:       fakeDNSDial(answer),
+		Servers:    []string{"127.0.0.1"},
+		PreferIPv4: true,
+	}
+
+	addrs, err := resolver.LookupIP(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("LookupIP failed: %s", err)
+	}
+	if len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("unexpected addrs: %v", addrs)
+	}
+}
+
+func TestResolverLookupIPRetriesOnServerFailure(t *testing.T) {
+
+	var attempts int32
+	answer := func(query *dns.Msg) *dns.Msg {
+		response := new(dns.Msg)
+		response.SetReply(query)
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			response.Rcode = dns.RcodeServerFailure
+			return response
+		}
+		rr, err := dns.NewRR(query.Question[0].Name + " 300 IN A 127.0.0.1")
+		if err != nil {
+			t.Fatalf("NewRR failed: %s", err)
+		}
+		response.Answer = append(response.Answer, rr)
+		return response
+	}
+
+	resolver := &Resolver{
+		Dial:       fakeDNSDial(answer),
+		Servers:    []string{"127.0.0.1"},
+		PreferIPv4: true,
+	}
+
+	addrs, err := resolver.LookupIP(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("LookupIP failed: %s", err)
+	}
+	if atomic.LoadInt32(&attempts) < 2 {
+		t.Fatalf("expected a retry after SERVFAIL, got %d attempt(s)", attempts)
+	}
+	if len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("unexpected addrs: %v", addrs)
+	}
+}
+
+func TestResolverLookupIPDoesNotCollapseTTLOnEmptyQueryType(t *testing.T) {
+
+	// example.com has an A record with a long TTL but no AAAA record;
+	// the AAAA query returns a successful, empty answer. The combined
+	// TTL must reflect the A record's TTL, not collapse to 0.
+	answer := func(query *dns.Msg) *dns.Msg {
+		response := new(dns.Msg)
+		response.SetReply(query)
+		if query.Question[0].Qtype == dns.TypeA {
+			rr, err := dns.NewRR(query.Question[0].Name + " 3600 IN A 127.0.0.1")
+			if err != nil {
+				t.Fatalf("NewRR failed: %s", err)
+			}
+			response.Answer = append(response.Answer, rr)
+		}
+		return response
+	}
+
+	resolver := &Resolver{
+		Dial:    fakeDNSDial(answer),
+		Servers: []string{"127.0.0.1"},
+	}
+
+	_, ttl, err := resolver.lookupIP(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("lookupIP failed: %s", err)
+	}
+	if ttl.Seconds() != 3600 {
+		t.Fatalf("expected combined ttl of 3600s, got %s", ttl)
+	}
+}
+
+func TestResolverLookupIPNameErrorIsNotRetriedAndIsAnError(t *testing.T) {
+
+	var attempts int32
+	answer := func(query *dns.Msg) *dns.Msg {
+		atomic.AddInt32(&attempts, 1)
+		response := new(dns.Msg)
+		response.SetReply(query)
+		response.Rcode = dns.RcodeNameError
+		return response
+	}
+
+	resolver := &Resolver{
+		Dial:       fakeDNSDial(answer),
+		Servers:    []string{"127.0.0.1"},
+		PreferIPv4: true,
+	}
+
+	_, err := resolver.LookupIP(context.Background(), "nxdomain.example.com")
+	if err == nil {
+		t.Fatalf("expected NXDOMAIN to be surfaced as an error")
+	}
+	if atomic.LoadInt32(&attempts) != 1 {
+		t.Fatalf("expected NXDOMAIN not to be retried, got %d attempt(s)", attempts)
+	}
+}